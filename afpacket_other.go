@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// openAfpacketCapture is only implemented on Linux; AF_PACKET is a
+// Linux-specific socket family, so other platforms must use -capture pcap.
+func openAfpacketCapture(intf string, worker, workerCount int) (captureBackend, error) {
+	return nil, fmt.Errorf("afpacket capture backend is only supported on Linux; use -capture pcap on this platform")
+}
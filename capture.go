@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// captureStats is a backend-agnostic view of the NIC counters used for both
+// the Prometheus gauges and the pcapng Interface Statistics Block. pcap
+// fills all three from its own counters; afpacket has no interface-level
+// drop counter and reports its freeze-queue count as PacketsIfDropped.
+type captureStats struct {
+	PacketsReceived  uint64
+	PacketsDropped   uint64
+	PacketsIfDropped uint64
+}
+
+// captureBackend abstracts the packet source doSniff reads from, so the
+// flow-tracking/output loop doesn't care whether packets arrive via libpcap
+// or an AF_PACKET ring.
+type captureBackend interface {
+	ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	Stats() (captureStats, error)
+	Close()
+}
+
+// ringFillReporter is implemented by backends that can report how full their
+// packet ring is, so operators can tune block counts. pcap has no such
+// concept; afpacket does. It takes the captureStats from the same Stats()
+// call the caller already made, rather than querying the kernel again,
+// since the underlying counters are read-and-clear.
+type ringFillReporter interface {
+	RingFillLevel(stats captureStats) float64
+}
+
+// openCapture opens intf using the backend selected by -capture. workerCount
+// is only meaningful to afpacket, which joins a PACKET_FANOUT group shared by
+// every worker on the same interface when it is above 1; no backend uses
+// worker.
+func openCapture(intf string, worker, workerCount int) (captureBackend, error) {
+	switch captureMode {
+	case "pcap":
+		return openPcapCapture(intf)
+	case "afpacket":
+		return openAfpacketCapture(intf, worker, workerCount)
+	default:
+		return nil, fmt.Errorf("unknown -capture backend %q", captureMode)
+	}
+}
+
+type pcapBackend struct {
+	handle *pcap.Handle
+}
+
+func openPcapCapture(intf string) (captureBackend, error) {
+	handle, err := pcap.OpenLive(intf, MAX_ETHERNET_MTU, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &pcapBackend{handle}, nil
+}
+
+func (b *pcapBackend) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return b.handle.ZeroCopyReadPacketData()
+}
+
+func (b *pcapBackend) Stats() (captureStats, error) {
+	s, err := b.handle.Stats()
+	if err != nil {
+		return captureStats{}, err
+	}
+	return captureStats{
+		PacketsReceived:  uint64(s.PacketsReceived),
+		PacketsDropped:   uint64(s.PacketsDropped),
+		PacketsIfDropped: uint64(s.PacketsIfDropped),
+	}, nil
+}
+
+func (b *pcapBackend) Close() {
+	b.handle.Close()
+}
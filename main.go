@@ -13,13 +13,15 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/tcpassembly"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -42,10 +44,31 @@ var (
 	flowPacketCutoff   uint
 	writeOutputPath    string
 	writeCompressed    bool
+	outputFormat       string
 
 	rotationInterval time.Duration
+
+	captureMode string
+	workers     int
+
+	afpacketBlockSize    int
+	afpacketBlockCount   int
+	afpacketBlockTimeout time.Duration
+)
+
+// ifaceStats holds, per interface, the capture stats most recently reported
+// by whichever of that interface's workers polled last; values are not
+// summed across workers. It feeds, in pcapng mode, the Interface Statistics
+// Block written at rotation time (the Prometheus gauges are set per worker
+// directly in doSniff).
+var (
+	ifaceStatsMu sync.Mutex
+	ifaceStats   = map[string]captureStats{}
 )
 
+// l7Emit is shared by every worker's assembler; nil when -l7-output is unset.
+var l7Emit *l7Emitter
+
 //Metrics
 var (
 	labels = []string{
@@ -131,6 +154,14 @@ var (
 			Help: "Number of packets dropped by NIC at the interface",
 		}, labels,
 	)
+
+	// Only populated by backends that implement ringFillReporter (currently afpacket).
+	mRingFill = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gotm_capture_ring_fill_level",
+			Help: "Capture ring pressure indicator: 1 if the backend's latest stats report ring queue freezes, else 0, where supported",
+		}, labels,
+	)
 )
 
 func init() {
@@ -143,7 +174,13 @@ func init() {
 	flag.UintVar(&flowPacketCutoff, "packetcutoff", 100, "Cut off flows after this many packets")
 	flag.StringVar(&writeOutputPath, "write", "out", "Output path is $writeOutputPath/yyyy/mm/dd/ts.pcap")
 	flag.BoolVar(&writeCompressed, "compress", false, "gzip pcaps as they are written")
+	flag.StringVar(&outputFormat, "format", "pcap", "Output file format: pcap or pcapng")
 	flag.DurationVar(&rotationInterval, "rotationinterval", 300*time.Second, "Interval between pcap rotations")
+	flag.StringVar(&captureMode, "capture", "pcap", "Capture backend: pcap or afpacket (Linux only)")
+	flag.IntVar(&workers, "workers", 1, "Number of capture workers/rings per interface (overridden by SNF_NUM_RINGS if set)")
+	flag.IntVar(&afpacketBlockSize, "afpacket-blocksize", 1<<20, "afpacket: TPACKET_V3 ring block size in bytes")
+	flag.IntVar(&afpacketBlockCount, "afpacket-blocks", 64, "afpacket: number of blocks in the TPACKET_V3 ring")
+	flag.DurationVar(&afpacketBlockTimeout, "afpacket-blocktimeout", 100*time.Millisecond, "afpacket: block poll timeout")
 
 	prometheus.MustRegister(mActiveFlows)
 	prometheus.MustRegister(mExpired)
@@ -157,6 +194,7 @@ func init() {
 	prometheus.MustRegister(mDropped)
 	prometheus.MustRegister(mIfDropped)
 	prometheus.MustRegister(mFlowSize)
+	prometheus.MustRegister(mRingFill)
 }
 
 type trackedFlow struct {
@@ -164,6 +202,14 @@ type trackedFlow struct {
 	bytecount uint
 	last      time.Time
 	logged    bool
+
+	// cutoffReason, once set, records why we stopped emitting packets for
+	// this flow ("bytecutoff" or "packetcutoff"). pending holds the most
+	// recently captured-but-not-yet-sent frame for the flow, so that once
+	// we learn it was the last one (cutoff or flowtimeout) we can still
+	// attach a pcapng comment to it before handing it to the writer.
+	cutoffReason string
+	pending      *PcapFrame
 }
 
 func (t trackedFlow) String() string {
@@ -171,8 +217,10 @@ func (t trackedFlow) String() string {
 }
 
 type PcapFrame struct {
-	ci   gopacket.CaptureInfo
-	data []byte
+	iface   string
+	ci      gopacket.CaptureInfo
+	data    []byte
+	comment string
 }
 
 type FiveTuple struct {
@@ -198,26 +246,69 @@ func mustAtoiWithDefault(s string, defaultValue int) int {
 	return i
 }
 
-func doSniff(intf string, worker int, writerchan chan PcapFrame) {
+// flushers holds the callbacks capture workers register for state that would
+// otherwise be silently dropped on shutdown: a worker's held-back pcapng
+// "pending" frame, and its l7StreamFactory's still-in-flight connections.
+// registerFlusher is called once per such callback by doSniff.
+var (
+	flushersMu sync.Mutex
+	flushers   []func()
+)
+
+func registerFlusher(f func()) {
+	flushersMu.Lock()
+	flushers = append(flushers, f)
+	flushersMu.Unlock()
+}
+
+// flushPendingWorkers runs every registered flusher. Without this, the most
+// recent packet of any flow that hadn't yet hit a cutoff or timeout, and the
+// L7 record of any TCP connection still active, would be silently dropped
+// on shutdown.
+func flushPendingWorkers() {
+	flushersMu.Lock()
+	defer flushersMu.Unlock()
+	for _, f := range flushers {
+		f()
+	}
+}
+
+func doSniff(intf string, worker int, workerCount int, writerchan chan PcapFrame) {
 	runtime.LockOSThread()
 	log.Printf("Starting worker %d on interface %s", worker, intf)
 	workerString := fmt.Sprintf("%d", worker)
 
-	var err error
-	handle, err := pcap.OpenLive(intf, MAX_ETHERNET_MTU, true, pcap.BlockForever)
+	backend, err := openCapture(intf, worker, workerCount)
 	if err != nil {
 		panic(err)
 	}
-	err = handle.SetBPFFilter(filter)
-	if err != nil { // optional
-		panic(err)
-	}
+	defer backend.Close()
 
 	seen := make(map[FiveTuple]*trackedFlow)
 	var totalFlows, removedFlows, totalBytes, outputBytes, totalPackets, outputPackets uint
-	var pcapStats *pcap.Stats
+	var capStats captureStats
 	lastcleanup := time.Now()
 
+	// pendingMu guards seen and every trackedFlow.pending in it, so that
+	// flushPendingWorkers (called from main's shutdown path) can safely
+	// drain this worker's held-back frames without racing the capture loop
+	// below.
+	var pendingMu sync.Mutex
+	registerFlusher(func() {
+		pendingMu.Lock()
+		var pending []PcapFrame
+		for _, flw := range seen {
+			if flw.pending != nil {
+				pending = append(pending, *flw.pending)
+				flw.pending = nil
+			}
+		}
+		pendingMu.Unlock()
+		for _, pcf := range pending {
+			writerchan <- pcf
+		}
+	})
+
 	var eth layers.Ethernet
 	var dot1q layers.Dot1Q
 	var ip4 layers.IPv4
@@ -228,8 +319,18 @@ func doSniff(intf string, worker int, writerchan chan PcapFrame) {
 	parser.IgnoreUnsupported = true
 	decoded := []gopacket.LayerType{}
 	var speedup int
+
+	// Reassembly is opt-in (-l7-output) and runs alongside flow tracking on
+	// the uncut stream, independent of the pcap byte/packet cutoff below.
+	var l7Assembler *tcpassembly.Assembler
+	var l7Factory *l7StreamFactory
+	if l7Emit != nil {
+		l7Factory = newL7StreamFactory(l7Emit)
+		l7Assembler = tcpassembly.NewAssembler(tcpassembly.NewStreamPool(l7Factory))
+		registerFlusher(l7Factory.FlushAll)
+	}
 	for {
-		packetData, ci, err := handle.ZeroCopyReadPacketData()
+		packetData, ci, err := backend.ZeroCopyReadPacketData()
 		if err == io.EOF {
 			break
 		} else if err != nil {
@@ -256,6 +357,11 @@ func doSniff(intf string, worker int, writerchan chan PcapFrame) {
 			}
 		}
 
+		if l7Assembler != nil && flow.proto == layers.IPProtocolTCP {
+			l7Assembler.AssembleWithTimestamp(flow.networkFlow, &tcp, ci.Timestamp)
+		}
+
+		pendingMu.Lock()
 		flw := seen[flow]
 		if flw == nil {
 			flw = &trackedFlow{}
@@ -269,6 +375,8 @@ func doSniff(intf string, worker int, writerchan chan PcapFrame) {
 		if pl > MINIMUM_IP_PACKET_SIZE {
 			flw.bytecount += pl - MINIMUM_IP_PACKET_SIZE
 		}
+
+		var toSend []PcapFrame
 		if flw.bytecount < flowByteCutoff && flw.packets < flowPacketCutoff {
 			//log.Println(flow, flw, "continues")
 			outputPackets += 1
@@ -276,38 +384,91 @@ func doSniff(intf string, worker int, writerchan chan PcapFrame) {
 
 			packetDataCopy := make([]byte, len(packetData))
 			copy(packetDataCopy, packetData)
-
-			writerchan <- PcapFrame{ci, packetDataCopy}
-		} else if flw.logged == false && flw.bytecount > LARGE_FLOW_SIZE {
-			log.Printf("Large flow over 8GB: %s", flow)
-			flw.logged = true
+			next := PcapFrame{intf, ci, packetDataCopy, ""}
+
+			if outputFormat == "pcapng" {
+				// Hold the most recent packet back one cycle so that, if it
+				// turns out to be this flow's last (cutoff or timeout), we
+				// can retroactively attach the reason as a pcapng comment
+				// before handing it to the writer. Plain pcap has no
+				// per-packet comment concept, so there's nothing to gain by
+				// delaying there -- write immediately instead.
+				if flw.pending != nil {
+					toSend = append(toSend, *flw.pending)
+				}
+				flw.pending = &next
+			} else {
+				toSend = append(toSend, next)
+			}
+		} else {
+			if flw.cutoffReason == "" {
+				if flw.bytecount >= flowByteCutoff {
+					flw.cutoffReason = "bytecutoff"
+				} else {
+					flw.cutoffReason = "packetcutoff"
+				}
+				if flw.pending != nil {
+					flw.pending.comment = flw.cutoffReason
+					toSend = append(toSend, *flw.pending)
+					flw.pending = nil
+				}
+			}
+			if flw.logged == false && flw.bytecount > LARGE_FLOW_SIZE {
+				log.Printf("Large flow over 16GB: %s", flow)
+				flw.logged = true
+			}
+		}
+		pendingMu.Unlock()
+		for _, pcf := range toSend {
+			writerchan <- pcf
 		}
 		//Cleanup
 		speedup++
 		if speedup == 5000 {
 			speedup = 0
-			pcapStats, err = handle.Stats()
+			capStats, err = backend.Stats()
 			if err != nil {
 				log.Fatal(err)
 			}
+			ifaceStatsMu.Lock()
+			ifaceStats[intf] = capStats
+			ifaceStatsMu.Unlock()
+			if filler, ok := backend.(ringFillReporter); ok {
+				mRingFill.WithLabelValues(intf, workerString).Set(filler.RingFillLevel(capStats))
+			}
 			if time.Since(lastcleanup) > packetTimeInterval {
 				lastcleanup = time.Now()
+				if l7Assembler != nil {
+					l7Assembler.FlushOlderThan(lastcleanup.Add(-flowTimeout))
+					l7Factory.FlushOlderThan(lastcleanup.Add(-flowTimeout))
+				}
 				//seen = make(map[string]*trackedFlow)
+				pendingMu.Lock()
 				var remove []FiveTuple
+				var expired []PcapFrame
 				for flow, flw := range seen {
 					if lastcleanup.Sub(flw.last) > flowTimeout {
 						remove = append(remove, flow)
 						removedFlows += 1
 						mFlowSize.Observe(float64(flw.bytecount))
+						if flw.pending != nil {
+							flw.pending.comment = "flowtimeout"
+							expired = append(expired, *flw.pending)
+							flw.pending = nil
+						}
 					}
 				}
 				for _, rem := range remove {
 					delete(seen, rem)
 				}
+				pendingMu.Unlock()
+				for _, pcf := range expired {
+					writerchan <- pcf
+				}
 				log.Printf("if=%s W=%02d flows=%d removed=%d bytes=%d pkts=%d output=%d outpct=%.1f recvd=%d dropped=%d ifdropped=%d",
 					intf, worker, len(seen), len(remove),
 					totalBytes, totalPackets, outputPackets, 100*float64(outputPackets)/float64(totalPackets),
-					pcapStats.PacketsReceived, pcapStats.PacketsDropped, pcapStats.PacketsIfDropped)
+					capStats.PacketsReceived, capStats.PacketsDropped, capStats.PacketsIfDropped)
 
 				expireSeconds := float64(time.Since(lastcleanup).Seconds())
 				mExpired.WithLabelValues(intf, workerString).Set(float64(len(remove)))
@@ -330,15 +491,15 @@ func doSniff(intf string, worker int, writerchan chan PcapFrame) {
 			mOutput.WithLabelValues(intf, workerString).Add(float64(outputPackets))
 			outputPackets = 0
 
-			mReceived.WithLabelValues(intf, workerString).Set(float64(pcapStats.PacketsReceived))
-			mDropped.WithLabelValues(intf, workerString).Set(float64(pcapStats.PacketsDropped))
-			mIfDropped.WithLabelValues(intf, workerString).Set(float64(pcapStats.PacketsIfDropped))
+			mReceived.WithLabelValues(intf, workerString).Set(float64(capStats.PacketsReceived))
+			mDropped.WithLabelValues(intf, workerString).Set(float64(capStats.PacketsDropped))
+			mIfDropped.WithLabelValues(intf, workerString).Set(float64(capStats.PacketsIfDropped))
 		}
 	}
 }
 
 type pcapWrapper interface {
-	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+	WritePacket(ci gopacket.CaptureInfo, data []byte, ifaceName, comment string) error
 	Close() error
 }
 
@@ -347,12 +508,22 @@ type regularPcapWrapper struct {
 	*pcapgo.Writer
 }
 
+// WritePacket adapts the legacy pcap format, which has no notion of
+// per-interface IDs or per-packet comments, to the pcapWrapper interface.
+func (wrapper *regularPcapWrapper) WritePacket(ci gopacket.CaptureInfo, data []byte, ifaceName, comment string) error {
+	return wrapper.Writer.WritePacket(ci, data)
+}
+
 type gzippedPcapWrapper struct {
 	w io.WriteCloser
 	z *gzip.Writer
 	*pcapgo.Writer
 }
 
+func (wrapper *gzippedPcapWrapper) WritePacket(ci gopacket.CaptureInfo, data []byte, ifaceName, comment string) error {
+	return wrapper.Writer.WritePacket(ci, data)
+}
+
 func (wrapper *gzippedPcapWrapper) Close() error {
 	gzerr := wrapper.z.Close()
 	ferr := wrapper.w.Close()
@@ -367,32 +538,78 @@ func (wrapper *gzippedPcapWrapper) Close() error {
 	return nil
 }
 
-func openPcap(baseFilename string) (pcapWrapper, error) {
+// outputExtension returns the file extension for the configured outputFormat.
+func outputExtension() string {
+	if outputFormat == "pcapng" {
+		return "pcapng"
+	}
+	return "pcap"
+}
+
+// openPcap opens baseFilename and returns a pcapWrapper around it, plus a
+// counter tracking bytes written to disk (post-gzip, when compressed) so
+// callers can drive size-based rotation off the actual on-disk size.
+func openPcap(baseFilename string, ifaces []ngInterface) (pcapWrapper, *uint64, error) {
 	if writeCompressed {
 		baseFilename = baseFilename + ".gz"
 	}
-	log.Printf("Opening new pcap file %s", baseFilename)
+	log.Printf("Opening new %s file %s", outputFormat, baseFilename)
 	outf, err := os.Create(baseFilename)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	diskBytes := new(uint64)
+	cw := &countingWriteCloser{WriteCloser: outf, n: diskBytes}
+
+	if outputFormat == "pcapng" {
+		if writeCompressed {
+			outgz := gzip.NewWriter(cw)
+			ngWriter, err := newPcapngWriter(outgz, ifaces)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &gzippedPcapngWrapper{cw, outgz, ngWriter}, diskBytes, nil
+		}
+		ngWriter, err := newPcapngWriter(cw, ifaces)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &regularPcapngWrapper{cw, ngWriter}, diskBytes, nil
 	}
+
 	if writeCompressed {
-		outgz := gzip.NewWriter(outf)
+		outgz := gzip.NewWriter(cw)
 		pcapWriter := pcapgo.NewWriter(outgz)
 		pcapWriter.WriteFileHeader(65536, layers.LinkTypeEthernet) // new file, must do this.
-		return &gzippedPcapWrapper{outf, outgz, pcapWriter}, nil
-	} else {
-		pcapWriter := pcapgo.NewWriter(outf)
-		pcapWriter.WriteFileHeader(65536, layers.LinkTypeEthernet) // new file, must do this.
-		return &regularPcapWrapper{outf, pcapWriter}, nil
+		return &gzippedPcapWrapper{cw, outgz, pcapWriter}, diskBytes, nil
 	}
+	pcapWriter := pcapgo.NewWriter(cw)
+	pcapWriter.WriteFileHeader(65536, layers.LinkTypeEthernet) // new file, must do this.
+	return &regularPcapWrapper{cw, pcapWriter}, diskBytes, nil
+}
+
+// countingWriteCloser wraps an io.WriteCloser, atomically counting bytes
+// actually written to it -- i.e. compressed-on-disk bytes, when it sits
+// beneath a gzip.Writer.
+type countingWriteCloser struct {
+	io.WriteCloser
+	n *uint64
+}
+
+func (c *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
 }
 
 //renamePcap renames the 'current' file to
-//writeOutputPath/yyy/mm/dd/yyyy-mm-ddThh-mm-ss.pcap.gz
+//writeOutputPath/yyyy/mm/dd/yyyy-mm-ddThh-mm-ss.pcap.gz (or .pcapng.gz)
 
-func renamePcap(tempName, outputPath string) error {
-	datePart := time.Now().Format("2006/01/02/2006-01-02T15-04-05.pcap")
+// renamePcap moves tempName to its final resting place and, if a file was
+// actually moved, returns that new path so callers can hand it off for
+// upload. It returns ("", nil) if there was nothing to rename.
+func renamePcap(tempName, outputPath string) (string, error) {
+	datePart := time.Now().Format("2006/01/02/2006-01-02T15-04-05." + outputExtension())
 	if writeCompressed {
 		datePart = datePart + ".gz"
 		tempName = tempName + ".gz"
@@ -401,17 +618,18 @@ func renamePcap(tempName, outputPath string) error {
 	newName := filepath.Join(outputPath, datePart)
 	//Ensure the directori exists
 	if err := os.MkdirAll(filepath.Dir(newName), 0777); err != nil {
-		return err
+		return "", err
 	}
 	err := os.Rename(tempName, newName)
 
 	if err != nil && !os.IsNotExist(err) {
-		return err
+		return "", err
 	}
 	if err == nil {
 		log.Printf("moved %s to %s", tempName, newName)
+		return newName, nil
 	}
-	return nil
+	return "", nil
 }
 
 func metrics() {
@@ -423,23 +641,76 @@ func metrics() {
 	//Not fatal?
 }
 
+// writeInterfaceStats, when pcapWriter supports it (pcapng mode), appends an
+// Interface Statistics Block per interface using the latest NIC counters --
+// the same PacketsReceived/Dropped/IfDropped values already sent to
+// Prometheus -- just before the file is closed.
+func writeInterfaceStats(pcapWriter pcapWrapper) {
+	sw, ok := pcapWriter.(statsWriter)
+	if !ok {
+		return
+	}
+	ifaceStatsMu.Lock()
+	defer ifaceStatsMu.Unlock()
+	for name, stats := range ifaceStats {
+		if err := sw.WriteInterfaceStats(name, stats); err != nil {
+			log.Printf("Error writing interface stats block for %s: %v", name, err)
+		}
+	}
+}
+
+// drainPcapWriterChan writes out any frames already queued on ch without
+// blocking. It's used right before shutdown to pick up the frames
+// flushPendingWorkers just queued, since nothing else will drain ch once
+// main stops selecting on it.
+func drainPcapWriterChan(rw *RotatingWriter, ch chan PcapFrame) {
+	for {
+		select {
+		case pcf := <-ch:
+			if err := rw.WritePacket(pcf); err != nil {
+				log.Print("Error writing output pcap during shutdown flush", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
+	if outputFormat != "pcap" && outputFormat != "pcapng" {
+		log.Fatalf("Unknown -format %q, must be pcap or pcapng", outputFormat)
+	}
 
 	go metrics()
 
-	currentFileName := fmt.Sprintf("%s_current.pcap.tmp", iface)
+	var err error
+	l7Emit, err = newL7Emitter(l7Output)
+	if err != nil {
+		log.Fatal("Error configuring L7 output", err)
+	}
+
+	currentFileName := fmt.Sprintf("%s_current.%s.tmp", iface, outputExtension())
 	workerCountString := os.Getenv("SNF_NUM_RINGS")
-	workerCount := mustAtoiWithDefault(workerCountString, 1)
+	workerCount := mustAtoiWithDefault(workerCountString, workers)
 
 	pcapWriterChan := make(chan PcapFrame, 500000)
 
 	interfaceList := strings.Split(iface, ",")
+	ngIfaces := make([]ngInterface, 0, len(interfaceList))
+	for _, name := range interfaceList {
+		ngIfaces = append(ngIfaces, ngInterface{
+			name:     name,
+			filter:   filter,
+			linkType: layers.LinkTypeEthernet,
+			snaplen:  MAX_ETHERNET_MTU,
+		})
+	}
 
 	for _, iface := range interfaceList {
 		log.Printf("Starting capture on %s with %d workers", iface, workerCount)
 		for worker := 0; worker < workerCount; worker++ {
-			go doSniff(iface, worker, pcapWriterChan)
+			go doSniff(iface, worker, workerCount, pcapWriterChan)
 		}
 	}
 
@@ -447,50 +718,37 @@ func main() {
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	rotationTicker := time.NewTicker(rotationInterval)
 
-	//Rename any leftover pcap files from a previous run
-	renamePcap(currentFileName, writeOutputPath)
+	up, err := newUploader()
+	if err != nil {
+		log.Fatal("Error configuring upload sink", err)
+	}
 
-	var pcapWriter pcapWrapper
-	pcapWriter, err := openPcap(currentFileName)
+	rw, err := NewRotatingWriter(currentFileName, ngIfaces, up)
 	if err != nil {
 		log.Fatal("Error opening pcap", err)
 	}
+	startRetention(writeOutputPath)
 
 	for {
 		select {
 		case pcf := <-pcapWriterChan:
-			err := pcapWriter.WritePacket(pcf.ci, pcf.data)
-			if err != nil {
-				pcapWriter.Close()
+			if err := rw.WritePacket(pcf); err != nil {
 				log.Fatal("Error writing output pcap", err)
 			}
 
 		case <-rotationTicker.C:
 			log.Print("Rotating")
-			//FIXME: refactor/wrap the open/close/rename code?
-			err = pcapWriter.Close()
-			if err != nil {
-				log.Fatal("Error closing pcap", err)
-			}
-			err = renamePcap(currentFileName, writeOutputPath)
-			if err != nil {
-				log.Fatal("Error renaming pcap", err)
-			}
-			pcapWriter, err = openPcap(currentFileName)
-			if err != nil {
-				log.Fatal("Error opening pcap", err)
+			if err := rw.RotateNow("time"); err != nil {
+				log.Fatal("Error rotating pcap", err)
 			}
 
 		case <-signals:
 			log.Print("Control-C??")
-			err = pcapWriter.Close()
-			if err != nil {
+			flushPendingWorkers()
+			drainPcapWriterChan(rw, pcapWriterChan)
+			if err := rw.Close(); err != nil {
 				log.Fatal("Error Closing", err)
 			}
-			err = renamePcap(currentFileName, writeOutputPath)
-			if err != nil {
-				log.Fatal("Error renaming pcap", err)
-			}
 			os.Exit(0)
 		}
 	}
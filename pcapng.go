@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PCAPNG block types and option codes, per the pcapng spec
+// (https://github.com/pcapng/pcapng). Every block is laid out as
+// [u32 block_type][u32 total_length][body, padded to 4 bytes][u32 total_length].
+const (
+	ngBlockSHB = 0x0A0D0D0A
+	ngBlockIDB = 0x00000001
+	ngBlockEPB = 0x00000006
+	ngBlockISB = 0x00000005
+
+	ngByteOrderMagic = 0x1A2B3C4D
+
+	ngOptEndOfOpt = 0
+	ngOptComment  = 1
+	ngOptIfName   = 2
+	ngOptIfFilter = 11
+
+	ngOptIsbIfRecv = 4
+	ngOptIsbIfDrop = 5
+	ngOptIsbOsDrop = 7
+)
+
+// ngInterface describes one -interface entry for its Interface Description Block.
+type ngInterface struct {
+	name     string
+	filter   string
+	linkType layers.LinkType
+	snaplen  uint32
+}
+
+// statsWriter is implemented by pcapWrappers that can record per-interface
+// NIC counters (currently just pcapngWriter, via an Interface Statistics
+// Block). main checks for it with a type assertion before closing a file.
+type statsWriter interface {
+	WriteInterfaceStats(ifaceName string, stats captureStats) error
+}
+
+// pcapngWriter emits PCAPNG: one Section Header Block, one Interface
+// Description Block per capture interface, and an Enhanced Packet Block per
+// packet tagged with the interface it actually arrived on.
+type pcapngWriter struct {
+	w io.Writer
+
+	mu       sync.Mutex
+	ifaceIDs map[string]uint32
+}
+
+func newPcapngWriter(w io.Writer, ifaces []ngInterface) (*pcapngWriter, error) {
+	ngw := &pcapngWriter{w: w, ifaceIDs: make(map[string]uint32, len(ifaces))}
+	if err := ngw.writeSectionHeader(); err != nil {
+		return nil, err
+	}
+	for id, intf := range ifaces {
+		if err := ngw.writeInterfaceDescription(intf); err != nil {
+			return nil, err
+		}
+		ngw.ifaceIDs[intf.name] = uint32(id)
+	}
+	return ngw, nil
+}
+
+// regularPcapngWrapper and gzippedPcapngWrapper mirror regularPcapWrapper and
+// gzippedPcapWrapper: the pcapngWriter only knows how to encode blocks, these
+// wrappers own the underlying file (and optional gzip stream).
+type regularPcapngWrapper struct {
+	io.WriteCloser
+	*pcapngWriter
+}
+
+type gzippedPcapngWrapper struct {
+	w io.WriteCloser
+	z io.WriteCloser
+	*pcapngWriter
+}
+
+func (wrapper *gzippedPcapngWrapper) Close() error {
+	gzerr := wrapper.z.Close()
+	ferr := wrapper.w.Close()
+
+	if gzerr != nil {
+		return gzerr
+	}
+	if ferr != nil {
+		return ferr
+	}
+	return nil
+}
+
+func writeBlock(w io.Writer, blockType uint32, body []byte) error {
+	pad := (4 - len(body)%4) % 4
+	total := 12 + len(body) + pad
+
+	buf := make([]byte, 8, total)
+	binary.LittleEndian.PutUint32(buf[0:4], blockType)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(total))
+	buf = append(buf, body...)
+	buf = append(buf, make([]byte, pad)...)
+
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(total))
+	buf = append(buf, trailer[:]...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendOption(buf *bytes.Buffer, code uint16, value []byte) {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:2], code)
+	binary.LittleEndian.PutUint16(hdr[2:4], uint16(len(value)))
+	buf.Write(hdr[:])
+	buf.Write(value)
+	if pad := (4 - len(value)%4) % 4; pad > 0 {
+		buf.Write(make([]byte, pad))
+	}
+}
+
+func appendEndOfOpt(buf *bytes.Buffer) {
+	var end [4]byte // code=0, length=0
+	buf.Write(end[:])
+}
+
+func (ngw *pcapngWriter) writeSectionHeader() error {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], ngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:6], 1) // major
+	binary.LittleEndian.PutUint16(body[6:8], 0) // minor
+	binary.LittleEndian.PutUint64(body[8:16], ^uint64(0)) // section length unknown
+	return writeBlock(ngw.w, ngBlockSHB, body)
+}
+
+func (ngw *pcapngWriter) writeInterfaceDescription(intf ngInterface) error {
+	body := new(bytes.Buffer)
+	var hdr [8]byte
+	binary.LittleEndian.PutUint16(hdr[0:2], uint16(intf.linkType))
+	binary.LittleEndian.PutUint16(hdr[2:4], 0) // reserved
+	binary.LittleEndian.PutUint32(hdr[4:8], intf.snaplen)
+	body.Write(hdr[:])
+
+	if intf.name != "" {
+		appendOption(body, ngOptIfName, []byte(intf.name))
+	}
+	if intf.filter != "" {
+		// if_filter: one byte of filter type (0 = BPF) followed by the filter string.
+		appendOption(body, ngOptIfFilter, append([]byte{0}, []byte(intf.filter)...))
+	}
+	appendEndOfOpt(body)
+
+	return writeBlock(ngw.w, ngBlockIDB, body.Bytes())
+}
+
+// WritePacket implements pcapWrapper. ifaceName selects which Interface
+// Description Block this Enhanced Packet Block references; comment, when
+// non-empty, is attached as the reason a flow was cut off at this packet.
+func (ngw *pcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, ifaceName, comment string) error {
+	ngw.mu.Lock()
+	defer ngw.mu.Unlock()
+
+	ifaceID, ok := ngw.ifaceIDs[ifaceName]
+	if !ok {
+		// Every worker's interface was registered when the file was opened.
+		return fmt.Errorf("pcapng: packet for unregistered interface %q", ifaceName)
+	}
+
+	ts := uint64(ci.Timestamp.UnixMicro())
+
+	body := new(bytes.Buffer)
+	var hdr [20]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], ifaceID)
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(ci.Length))
+	body.Write(hdr[:])
+
+	body.Write(data)
+	if pad := (4 - len(data)%4) % 4; pad > 0 {
+		body.Write(make([]byte, pad))
+	}
+	if comment != "" {
+		appendOption(body, ngOptComment, []byte(comment))
+	}
+	appendEndOfOpt(body)
+
+	return writeBlock(ngw.w, ngBlockEPB, body.Bytes())
+}
+
+// WriteInterfaceStats emits an Interface Statistics Block for ifaceName,
+// mirroring the NIC counters already exported to Prometheus.
+func (ngw *pcapngWriter) WriteInterfaceStats(ifaceName string, stats captureStats) error {
+	ngw.mu.Lock()
+	defer ngw.mu.Unlock()
+
+	ifaceID, ok := ngw.ifaceIDs[ifaceName]
+	if !ok {
+		return fmt.Errorf("pcapng: stats for unregistered interface %q", ifaceName)
+	}
+
+	now := uint64(time.Now().UnixMicro())
+
+	body := new(bytes.Buffer)
+	var hdr [12]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], ifaceID)
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(now>>32))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(now))
+	body.Write(hdr[:])
+
+	var recv, drop, osdrop [8]byte
+	binary.LittleEndian.PutUint64(recv[:], uint64(stats.PacketsReceived))
+	binary.LittleEndian.PutUint64(drop[:], uint64(stats.PacketsDropped))
+	binary.LittleEndian.PutUint64(osdrop[:], uint64(stats.PacketsIfDropped))
+	appendOption(body, ngOptIsbIfRecv, recv[:])
+	appendOption(body, ngOptIsbIfDrop, drop[:])
+	appendOption(body, ngOptIsbOsDrop, osdrop[:])
+	appendEndOfOpt(body)
+
+	return writeBlock(ngw.w, ngBlockISB, body.Bytes())
+}
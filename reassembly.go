@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var l7Output string
+
+func init() {
+	flag.StringVar(&l7Output, "l7-output", "", "Where to emit L7 flow records (JSON lines): a file path, or udp://host:port. Empty disables TCP reassembly.")
+
+	prometheus.MustRegister(mL7Streams)
+	prometheus.MustRegister(mL7ReassemblyMemory)
+}
+
+var (
+	mL7Streams = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotm_l7_streams_total",
+			Help: "Number of completed L7 streams by protocol",
+		}, []string{"proto"},
+	)
+	mL7ReassemblyMemory = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gotm_l7_reassembly_memory_bytes",
+			Help: "Approximate bytes currently held by the L7 protocol-sniffing buffers",
+		},
+	)
+)
+
+// l7SniffLimit bounds how much of each half-connection we buffer for
+// protocol identification; HTTP request/response lines and TLS ClientHellos
+// both fit comfortably within it.
+const l7SniffLimit = 4096
+
+// l7Record is one completed TCP stream's worth of L7 metadata, emitted as a
+// single JSON line.
+type l7Record struct {
+	SrcIP   string    `json:"src_ip"`
+	SrcPort string    `json:"src_port"`
+	DstIP   string    `json:"dst_ip"`
+	DstPort string    `json:"dst_port"`
+	Proto   string    `json:"proto"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Bytes   uint64    `json:"bytes"`
+	Packets uint64    `json:"packets"`
+
+	// HTTP
+	Method string `json:"method,omitempty"`
+	Host   string `json:"host,omitempty"`
+	URI    string `json:"uri,omitempty"`
+	Status int    `json:"status,omitempty"`
+
+	// TLS
+	SNI string `json:"sni,omitempty"`
+	JA3 string `json:"ja3,omitempty"`
+}
+
+// l7Emitter writes completed l7Records out as JSON lines, to either a file
+// or a UDP socket.
+type l7Emitter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newL7Emitter(target string) (*l7Emitter, error) {
+	if target == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(target, "udp://") {
+		conn, err := net.Dial("udp", strings.TrimPrefix(target, "udp://"))
+		if err != nil {
+			return nil, fmt.Errorf("l7-output: dialing %s: %w", target, err)
+		}
+		return &l7Emitter{w: conn}, nil
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("l7-output: opening %s: %w", target, err)
+	}
+	return &l7Emitter{w: f}, nil
+}
+
+func (e *l7Emitter) emit(rec l7Record) {
+	if e == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("l7: error marshaling record: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	e.mu.Lock()
+	_, err = e.w.Write(data)
+	e.mu.Unlock()
+	if err != nil {
+		log.Printf("l7: error writing record: %v", err)
+	}
+
+	mL7Streams.WithLabelValues(protoOrUnknown(rec.Proto)).Inc()
+}
+
+func protoOrUnknown(proto string) string {
+	if proto == "" {
+		return "unknown"
+	}
+	return proto
+}
+
+// l7StreamFactory implements tcpassembly.StreamFactory. It's shared by a
+// single worker's assembler, and pairs up the two directions of each TCP
+// connection into one l7Conn before emitting a record.
+type l7StreamFactory struct {
+	emitter *l7Emitter
+
+	mu    sync.Mutex
+	conns map[string]*l7Conn
+}
+
+func newL7StreamFactory(emitter *l7Emitter) *l7StreamFactory {
+	return &l7StreamFactory{emitter: emitter, conns: make(map[string]*l7Conn)}
+}
+
+// canonicalKey maps both directions of a TCP connection to the same key.
+func canonicalKey(netFlow, transport gopacket.Flow) string {
+	fwd := netFlow.String() + "|" + transport.String()
+	rev := netFlow.Reverse().String() + "|" + transport.Reverse().String()
+	if fwd < rev {
+		return fwd
+	}
+	return rev
+}
+
+func (f *l7StreamFactory) New(netFlow, transport gopacket.Flow) tcpassembly.Stream {
+	key := canonicalKey(netFlow, transport)
+
+	f.mu.Lock()
+	conn, exists := f.conns[key]
+	toServer := true
+	if !exists {
+		conn = &l7Conn{key: key, netFlow: netFlow, transport: transport}
+		f.conns[key] = conn
+	} else {
+		// Second direction seen for this connection.
+		toServer = false
+	}
+	f.mu.Unlock()
+
+	return &l7Stream{conn: conn, toServer: toServer}
+}
+
+// FlushOlderThan emits and discards every tracked connection that hasn't
+// seen activity since threshold. Completion is driven by idle time rather
+// than by both directions reaching ReassemblyComplete, because a capture
+// that starts mid-connection -- a process restart with long-lived sessions
+// already open, or a span port that only shows one side's payload -- means
+// tcpassembly may never see a qualifying packet (SYN, FIN/RST, or nonzero
+// payload) for one direction, so it never calls New for that half and that
+// half never "completes". Caller passes the same cutoff it uses to expire
+// flows (see doSniff's packetTimeInterval/flowTimeout cleanup).
+func (f *l7StreamFactory) FlushOlderThan(threshold time.Time) {
+	f.mu.Lock()
+	var idle []*l7Conn
+	for key, conn := range f.conns {
+		if conn.lastActivity().Before(threshold) {
+			delete(f.conns, key)
+			idle = append(idle, conn)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.emit(f.emitter)
+	}
+}
+
+// FlushAll emits and discards every tracked connection unconditionally,
+// regardless of idle time. Call it on shutdown, so TCP connections that
+// were still active (and so wouldn't be picked up by FlushOlderThan) don't
+// lose their buffered L7 record.
+func (f *l7StreamFactory) FlushAll() {
+	f.mu.Lock()
+	conns := make([]*l7Conn, 0, len(f.conns))
+	for key, conn := range f.conns {
+		conns = append(conns, conn)
+		delete(f.conns, key)
+	}
+	f.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.emit(f.emitter)
+	}
+}
+
+// l7Conn accumulates both directions of one TCP connection: byte/packet
+// totals for the whole flow, plus a capped per-direction buffer used only
+// to sniff the protocol. It runs independent of the pcap byte/packet
+// cutoff, so reassembly sees the uncut stream even when output packets for
+// the flow are being suppressed.
+type l7Conn struct {
+	mu sync.Mutex
+
+	key       string
+	netFlow   gopacket.Flow
+	transport gopacket.Flow
+
+	start, end     time.Time
+	bytes, packets uint64
+
+	sniffBuf      [2]bytes.Buffer // 0 = client->server, 1 = server->client
+	bufferedBytes int
+
+	proto  string
+	fields map[string]interface{}
+}
+
+// lastActivity returns the timestamp of the most recent packet observed on
+// either direction of this connection.
+func (c *l7Conn) lastActivity() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.end
+}
+
+func (c *l7Conn) observe(toServer bool, data []byte, seen time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.start.IsZero() || seen.Before(c.start) {
+		c.start = seen
+	}
+	if seen.After(c.end) {
+		c.end = seen
+	}
+	c.bytes += uint64(len(data))
+	c.packets++
+
+	idx := 0
+	if !toServer {
+		idx = 1
+	}
+	if buf := &c.sniffBuf[idx]; buf.Len() < l7SniffLimit {
+		n := l7SniffLimit - buf.Len()
+		if n > len(data) {
+			n = len(data)
+		}
+		buf.Write(data[:n])
+		c.bufferedBytes += n
+		mL7ReassemblyMemory.Add(float64(n))
+		c.sniff()
+	}
+}
+
+func (c *l7Conn) sniff() {
+	if c.proto != "" {
+		return
+	}
+	if fields, ok := sniffHTTP(c.sniffBuf[0].Bytes(), c.sniffBuf[1].Bytes()); ok {
+		c.proto = "http"
+		c.fields = fields
+		return
+	}
+	if fields, ok := sniffTLSClientHello(c.sniffBuf[0].Bytes()); ok {
+		c.proto = "tls"
+		c.fields = fields
+	}
+}
+
+func (c *l7Conn) emit(emitter *l7Emitter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	src, dst := c.netFlow.Endpoints()
+	sport, dport := c.transport.Endpoints()
+	rec := l7Record{
+		SrcIP:   src.String(),
+		DstIP:   dst.String(),
+		SrcPort: sport.String(),
+		DstPort: dport.String(),
+		Proto:   c.proto,
+		Start:   c.start,
+		End:     c.end,
+		Bytes:   c.bytes,
+		Packets: c.packets,
+	}
+	for k, v := range c.fields {
+		switch k {
+		case "method":
+			rec.Method, _ = v.(string)
+		case "host":
+			rec.Host, _ = v.(string)
+		case "uri":
+			rec.URI, _ = v.(string)
+		case "status":
+			rec.Status, _ = v.(int)
+		case "sni":
+			rec.SNI, _ = v.(string)
+		case "ja3":
+			rec.JA3, _ = v.(string)
+		}
+	}
+
+	mL7ReassemblyMemory.Sub(float64(c.bufferedBytes))
+	emitter.emit(rec)
+}
+
+// l7Stream implements tcpassembly.Stream for one direction of a connection.
+type l7Stream struct {
+	conn     *l7Conn
+	toServer bool
+}
+
+func (s *l7Stream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	for _, r := range reassembly {
+		if len(r.Bytes) == 0 {
+			continue
+		}
+		s.conn.observe(s.toServer, r.Bytes, r.Seen)
+	}
+}
+
+// ReassemblyComplete is a no-op: connections are retired by
+// l7StreamFactory.FlushOlderThan's idle sweep, not by both directions
+// closing, since one direction's stream may never be created at all (see
+// FlushOlderThan).
+func (s *l7Stream) ReassemblyComplete() {}
+
+// sniffHTTP looks for an HTTP/1.x request line in clientBuf and a status
+// line in serverBuf. Either half matching is enough to call it HTTP.
+func sniffHTTP(clientBuf, serverBuf []byte) (map[string]interface{}, bool) {
+	fields := map[string]interface{}{}
+	matched := false
+
+	if len(clientBuf) > 0 {
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(clientBuf)))
+		if err == nil {
+			fields["method"] = req.Method
+			fields["host"] = req.Host
+			fields["uri"] = req.URL.RequestURI()
+			matched = true
+		}
+	}
+	if len(serverBuf) > 0 {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(serverBuf)), nil)
+		if err == nil {
+			fields["status"] = resp.StatusCode
+			matched = true
+		}
+	}
+	return fields, matched
+}
+
+// sniffTLSClientHello looks for a TLS ClientHello at the start of clientBuf
+// and, if found, returns its SNI and JA3 fingerprint.
+func sniffTLSClientHello(clientBuf []byte) (map[string]interface{}, bool) {
+	sni, ja3, ok := parseTLSClientHello(clientBuf)
+	if !ok {
+		return nil, false
+	}
+	return map[string]interface{}{"sni": sni, "ja3": ja3}, true
+}
+
+// parseTLSClientHello hand-parses enough of a TLS record + handshake header
+// to pull out the fields JA3 fingerprints: version, cipher suites,
+// extensions, elliptic curves and EC point formats. It only needs to
+// succeed on the ClientHello; anything else returns ok=false.
+func parseTLSClientHello(data []byte) (sni, ja3 string, ok bool) {
+	// TLS record header: type(1) version(2) length(2).
+	if len(data) < 5 || data[0] != 0x16 {
+		return "", "", false
+	}
+	hs := data[5:]
+
+	// Handshake header: type(1) length(3).
+	if len(hs) < 4 || hs[0] != 0x01 {
+		return "", "", false
+	}
+	body := hs[4:]
+
+	// client_version(2) + random(32) + session_id_len(1).
+	if len(body) < 35 {
+		return "", "", false
+	}
+	version := uint16(body[0])<<8 | uint16(body[1])
+	pos := 2 + 32
+	sessIDLen := int(body[pos])
+	pos += 1 + sessIDLen
+
+	if pos+2 > len(body) {
+		return "", "", false
+	}
+	cipherLen := int(body[pos])<<8 | int(body[pos+1])
+	pos += 2
+	if pos+cipherLen > len(body) {
+		return "", "", false
+	}
+	ciphers := rawUint16List(body[pos : pos+cipherLen])
+	pos += cipherLen
+
+	if pos >= len(body) {
+		return "", "", false
+	}
+	compLen := int(body[pos])
+	pos += 1 + compLen
+
+	var extTypes, curves, pointFormats []uint16
+	if pos+2 <= len(body) {
+		extTotalLen := int(body[pos])<<8 | int(body[pos+1])
+		pos += 2
+		end := pos + extTotalLen
+		if end > len(body) {
+			end = len(body)
+		}
+		extBytes := body[pos:end]
+
+		p := 0
+		for p+4 <= len(extBytes) {
+			etype := uint16(extBytes[p])<<8 | uint16(extBytes[p+1])
+			elen := int(extBytes[p+2])<<8 | int(extBytes[p+3])
+			p += 4
+			if p+elen > len(extBytes) {
+				break
+			}
+			edata := extBytes[p : p+elen]
+			extTypes = append(extTypes, etype)
+			switch etype {
+			case 0: // server_name
+				sni = parseSNI(edata)
+			case 10: // supported_groups (elliptic curves)
+				curves = lengthPrefixedUint16List(edata)
+			case 11: // ec_point_formats
+				pointFormats = lengthPrefixedUint8List(edata)
+			}
+			p += elen
+		}
+	}
+
+	ja3 = buildJA3(version, ciphers, extTypes, curves, pointFormats)
+	return sni, ja3, true
+}
+
+func parseSNI(edata []byte) string {
+	if len(edata) < 2 {
+		return ""
+	}
+	listLen := int(edata[0])<<8 | int(edata[1])
+	end := 2 + listLen
+	if end > len(edata) {
+		end = len(edata)
+	}
+	for p := 2; p+3 <= end; {
+		nameType := edata[p]
+		nameLen := int(edata[p+1])<<8 | int(edata[p+2])
+		p += 3
+		if p+nameLen > end {
+			break
+		}
+		if nameType == 0 { // host_name
+			return string(edata[p : p+nameLen])
+		}
+		p += nameLen
+	}
+	return ""
+}
+
+func rawUint16List(data []byte) []uint16 {
+	out := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		out = append(out, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return out
+}
+
+func lengthPrefixedUint16List(data []byte) []uint16 {
+	if len(data) < 2 {
+		return nil
+	}
+	n := int(data[0])<<8 | int(data[1])
+	rest := data[2:]
+	if n < len(rest) {
+		rest = rest[:n]
+	}
+	return rawUint16List(rest)
+}
+
+func lengthPrefixedUint8List(data []byte) []uint16 {
+	if len(data) < 1 {
+		return nil
+	}
+	n := int(data[0])
+	rest := data[1:]
+	if n < len(rest) {
+		rest = rest[:n]
+	}
+	out := make([]uint16, 0, len(rest))
+	for _, b := range rest {
+		out = append(out, uint16(b))
+	}
+	return out
+}
+
+// buildJA3 joins the ClientHello fields into the standard JA3 string
+// ("version,ciphers,extensions,curves,pointformats", dash-separated within
+// each field) and returns its MD5 hex digest.
+func buildJA3(version uint16, ciphers, extensions, curves, pointFormats []uint16) string {
+	join := func(vals []uint16) string {
+		parts := make([]string, len(vals))
+		for i, v := range vals {
+			parts[i] = strconv.Itoa(int(v))
+		}
+		return strings.Join(parts, "-")
+	}
+
+	raw := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		join(ciphers),
+		join(extensions),
+		join(curves),
+		join(pointFormats),
+	}, ",")
+
+	sum := md5.Sum([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rotationMaxBytes   int64
+	rotationMaxPackets uint64
+
+	retentionMaxBytes int64
+	retentionMaxFiles int
+	retentionMaxAge   time.Duration
+	retentionInterval time.Duration
+)
+
+var (
+	mRotationTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gotm_rotation_total",
+			Help: "Number of output file rotations, by reason (time, bytes, packets, error, shutdown)",
+		}, []string{"reason"},
+	)
+	mRetentionDeleted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gotm_retention_deleted_total",
+			Help: "Number of rotated output files deleted by the retention policy",
+		},
+	)
+	mOutputDiskBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gotm_output_disk_bytes",
+			Help: "Total bytes currently occupied by rotated output files under -write",
+		},
+	)
+)
+
+func init() {
+	flag.Int64Var(&rotationMaxBytes, "rotation-bytes", 0, "Rotate the current output file once it reaches this many on-disk bytes (0 disables)")
+	flag.Uint64Var(&rotationMaxPackets, "rotation-packets", 0, "Rotate the current output file once this many packets have been written to it (0 disables)")
+	flag.Int64Var(&retentionMaxBytes, "retention-max-bytes", 0, "Delete the oldest rotated files under -write once their total size exceeds this many bytes (0 disables)")
+	flag.IntVar(&retentionMaxFiles, "retention-max-files", 0, "Delete the oldest rotated files under -write once more than this many exist (0 disables)")
+	flag.DurationVar(&retentionMaxAge, "retention-max-age", 0, "Delete rotated files under -write once older than this (0 disables)")
+	flag.DurationVar(&retentionInterval, "retention-interval", 5*time.Minute, "How often to re-check the retention caps")
+
+	prometheus.MustRegister(mRotationTotal)
+	prometheus.MustRegister(mRetentionDeleted)
+	prometheus.MustRegister(mOutputDiskBytes)
+}
+
+// RotatingWriter owns the lifecycle of the current output file: opening it,
+// writing packets to it, rotating it out (on a timer or once a size/packet
+// threshold is crossed) and handing the rotated file off to the uploader.
+// It replaces the open/close/rename logic that used to live inline in
+// main's select loop.
+type RotatingWriter struct {
+	mu sync.Mutex
+
+	currentFileName string
+	ifaces          []ngInterface
+	up              *uploader
+
+	writer    pcapWrapper
+	diskBytes *uint64
+	packets   uint64
+}
+
+// NewRotatingWriter renames any leftover output file from a previous run out
+// of the way, then opens a fresh current output file.
+func NewRotatingWriter(currentFileName string, ifaces []ngInterface, up *uploader) (*RotatingWriter, error) {
+	if leftover, err := renamePcap(currentFileName, writeOutputPath); err != nil {
+		log.Print("Error renaming leftover pcap", err)
+	} else {
+		up.enqueue(leftover)
+	}
+
+	rw := &RotatingWriter{
+		currentFileName: currentFileName,
+		ifaces:          ifaces,
+		up:              up,
+	}
+	if err := rw.openLocked(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *RotatingWriter) openLocked() error {
+	writer, diskBytes, err := openPcap(rw.currentFileName, rw.ifaces)
+	if err != nil {
+		return err
+	}
+	rw.writer = writer
+	rw.diskBytes = diskBytes
+	rw.packets = 0
+	return nil
+}
+
+// WritePacket writes pcf to the current output file, rotating first if a
+// size or packet threshold has already been crossed. If the write itself
+// fails, it still closes and renames the partial file before returning the
+// error, so a write error doesn't strand a half-written, still-.tmp-named
+// file in the output directory for the caller's (likely fatal) handling.
+func (rw *RotatingWriter) WritePacket(pcf PcapFrame) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if reason := rw.shouldRotateLocked(); reason != "" {
+		if err := rw.rotateLocked(reason); err != nil {
+			return err
+		}
+	}
+
+	if err := rw.writer.WritePacket(pcf.ci, pcf.data, pcf.iface, pcf.comment); err != nil {
+		if serr := rw.closeAndRenameLocked("error"); serr != nil {
+			log.Printf("Error salvaging partial output file after write error: %v", serr)
+		}
+		return err
+	}
+	rw.packets++
+	return nil
+}
+
+func (rw *RotatingWriter) shouldRotateLocked() string {
+	if rotationMaxBytes > 0 && rw.diskBytes != nil && atomic.LoadUint64(rw.diskBytes) >= uint64(rotationMaxBytes) {
+		return "bytes"
+	}
+	if rotationMaxPackets > 0 && rw.packets >= rotationMaxPackets {
+		return "packets"
+	}
+	return ""
+}
+
+// RotateNow closes the current output file, hands it to the uploader, and
+// opens a fresh one in its place. reason is recorded on mRotationTotal
+// ("time", "bytes", or "packets").
+func (rw *RotatingWriter) RotateNow(reason string) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rotateLocked(reason)
+}
+
+func (rw *RotatingWriter) rotateLocked(reason string) error {
+	if err := rw.closeAndRenameLocked(reason); err != nil {
+		return err
+	}
+	return rw.openLocked()
+}
+
+// closeAndRenameLocked closes the current output file and hands it to the
+// uploader, without opening a replacement.
+func (rw *RotatingWriter) closeAndRenameLocked(reason string) error {
+	writeInterfaceStats(rw.writer)
+	if err := rw.writer.Close(); err != nil {
+		return err
+	}
+	rotated, err := renamePcap(rw.currentFileName, writeOutputPath)
+	if err != nil {
+		return err
+	}
+	rw.up.enqueue(rotated)
+	mRotationTotal.WithLabelValues(reason).Inc()
+	return nil
+}
+
+// Close closes the current output file and hands it to the uploader without
+// opening a replacement. Call it once, at shutdown.
+func (rw *RotatingWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.closeAndRenameLocked("shutdown")
+}
+
+// startRetention launches a background goroutine that periodically enforces
+// the -retention-max-* caps against outputPath. It is a no-op if none of the
+// caps are configured.
+func startRetention(outputPath string) {
+	if retentionMaxBytes <= 0 && retentionMaxFiles <= 0 && retentionMaxAge <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			enforceRetention(outputPath)
+		}
+	}()
+}
+
+type retentionFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// enforceRetention walks outputPath for rotated output files and deletes the
+// oldest ones first until the total size, file count, and age are all
+// within their configured caps.
+func enforceRetention(outputPath string) {
+	var files []retentionFile
+	var totalBytes int64
+	err := filepath.Walk(outputPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // best effort -- a file vanishing mid-walk isn't fatal
+		}
+		if info.IsDir() || !isRotatedOutputFile(path) {
+			return nil
+		}
+		files = append(files, retentionFile{path, info.Size(), info.ModTime()})
+		totalBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		log.Print("Error walking output path for retention", err)
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	now := time.Now()
+	remaining := len(files)
+	for _, f := range files {
+		overBytes := retentionMaxBytes > 0 && totalBytes > retentionMaxBytes
+		overCount := retentionMaxFiles > 0 && remaining > retentionMaxFiles
+		overAge := retentionMaxAge > 0 && now.Sub(f.modTime) > retentionMaxAge
+		if !overBytes && !overCount && !overAge {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Error deleting %s for retention: %v", f.path, err)
+			continue
+		}
+		totalBytes -= f.size
+		remaining--
+		mRetentionDeleted.Inc()
+	}
+	mOutputDiskBytes.Set(float64(totalBytes))
+}
+
+// rotatedOutputExtensions are every extension this binary can rotate out
+// under -write, across both output formats and compression settings.
+// isRotatedOutputFile matches against all of them -- not just whatever
+// -format/-compress happen to be set to right now -- so files rotated
+// before an operator changed those flags are still recognized by the
+// retention policy instead of silently becoming invisible to it.
+var rotatedOutputExtensions = []string{".pcap", ".pcap.gz", ".pcapng", ".pcapng.gz"}
+
+// isRotatedOutputFile reports whether path looks like a rotated output file
+// this process produced, as opposed to some unrelated file an operator left
+// under -write.
+func isRotatedOutputFile(path string) bool {
+	for _, ext := range rotatedOutputExtensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	uploadURL                string
+	uploadBucket             string
+	uploadPrefix             string
+	uploadDeleteLocal        bool
+	uploadMultipartThreshold int64
+)
+
+var (
+	mUploadBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gotm_upload_bytes_total",
+			Help: "Total bytes successfully uploaded to the upload sink",
+		},
+	)
+	mUploadFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gotm_upload_failures_total",
+			Help: "Total failed upload attempts, including ones that were later retried",
+		},
+	)
+	mUploadQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gotm_upload_queue_depth",
+			Help: "Number of rotated files currently queued for upload",
+		},
+	)
+)
+
+func init() {
+	flag.StringVar(&uploadURL, "upload-url", "", "S3-compatible endpoint to upload rotated pcaps to (e.g. https://s3.us-east-1.amazonaws.com). Empty disables uploads.")
+	flag.StringVar(&uploadBucket, "upload-bucket", "", "Bucket to upload rotated pcaps to")
+	flag.StringVar(&uploadPrefix, "upload-prefix", "", "Key prefix for uploaded objects, joined with the file's path under -write")
+	flag.BoolVar(&uploadDeleteLocal, "upload-delete-local", false, "Delete the local file once it has been uploaded successfully")
+	flag.Int64Var(&uploadMultipartThreshold, "upload-multipart-threshold", 128<<20, "Files larger than this many bytes are uploaded as multipart")
+
+	prometheus.MustRegister(mUploadBytes)
+	prometheus.MustRegister(mUploadFailures)
+	prometheus.MustRegister(mUploadQueueDepth)
+}
+
+// uploadJob is one rotated file waiting to be pushed to the upload sink.
+type uploadJob struct {
+	path string // local path of the rotated file, under -write
+	key  string // full object key: -upload-prefix joined with the path under -write
+}
+
+// uploader pushes rotated pcap files to an S3-compatible endpoint in the
+// background, fed by a buffered channel from RotatingWriter's rotations.
+type uploader struct {
+	client *minio.Client
+	jobs   chan uploadJob
+}
+
+// newUploader returns (nil, nil) when -upload-url is unset, since uploads
+// are opt-in.
+func newUploader() (*uploader, error) {
+	if uploadURL == "" {
+		return nil, nil
+	}
+	if uploadBucket == "" {
+		return nil, fmt.Errorf("-upload-url requires -upload-bucket")
+	}
+
+	endpoint, err := url.Parse(uploadURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing -upload-url: %w", err)
+	}
+
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("GOTM_S3_ACCESS_KEY"), os.Getenv("GOTM_S3_SECRET_KEY"), ""),
+		Secure: endpoint.Scheme == "https",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	up := &uploader{client: client, jobs: make(chan uploadJob, 1000)}
+	go up.run()
+	return up, nil
+}
+
+// enqueue schedules localPath for upload. It is a no-op on a nil uploader
+// (uploads disabled) or an empty path (nothing was rotated).
+func (up *uploader) enqueue(localPath string) {
+	if up == nil || localPath == "" {
+		return
+	}
+
+	rel, err := filepath.Rel(writeOutputPath, localPath)
+	if err != nil {
+		rel = filepath.Base(localPath)
+	}
+	key := filepath.ToSlash(filepath.Join(uploadPrefix, rel))
+
+	up.jobs <- uploadJob{path: localPath, key: key}
+	mUploadQueueDepth.Set(float64(len(up.jobs)))
+}
+
+func (up *uploader) run() {
+	for job := range up.jobs {
+		mUploadQueueDepth.Set(float64(len(up.jobs)))
+		if err := up.uploadWithRetry(job); err != nil {
+			log.Printf("Giving up uploading %s: %v", job.path, err)
+			continue
+		}
+		if uploadDeleteLocal {
+			if err := os.Remove(job.path); err != nil {
+				log.Printf("Error deleting local file %s after upload: %v", job.path, err)
+			}
+		}
+	}
+}
+
+func (up *uploader) uploadWithRetry(job uploadJob) error {
+	const maxAttempts = 6
+	backoff := time.Second
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err := up.uploadOnce(job)
+		if err == nil {
+			return nil
+		}
+
+		lastErr = err
+		mUploadFailures.Inc()
+		log.Printf("Upload attempt %d/%d for %s failed: %v", attempt+1, maxAttempts, job.path, err)
+		if !isRetryableUploadError(err) {
+			return err
+		}
+	}
+	return lastErr
+}
+
+func (up *uploader) uploadOnce(job uploadJob) error {
+	info, err := os.Stat(job.path)
+	if err != nil {
+		return err // local file is gone; retrying won't help
+	}
+
+	f, err := os.Open(job.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+	if info.Size() > uploadMultipartThreshold {
+		opts.PartSize = uint64(uploadMultipartThreshold)
+	}
+
+	_, err = up.client.PutObject(context.Background(), uploadBucket, job.key, f, info.Size(), opts)
+	if err != nil {
+		return err
+	}
+
+	mUploadBytes.Add(float64(info.Size()))
+	log.Printf("Uploaded %s to s3://%s/%s", job.path, uploadBucket, job.key)
+	return nil
+}
+
+func isRetryableUploadError(err error) bool {
+	var errResp minio.ErrorResponse
+	if errors.As(err, &errResp) {
+		return errResp.StatusCode >= 500
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		// uploadOnce's os.Stat/os.Open failed against the local file itself
+		// (most commonly because it's gone) -- retrying won't help.
+		return false
+	}
+	// Not a well-formed S3 error response or a local file error -- treat as
+	// a network-level failure and retry.
+	return true
+}